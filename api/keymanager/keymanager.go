@@ -0,0 +1,100 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package keymanager is the client side of the KeyManager facade, used by
+// worker/authenticationworker to fetch the merged authorized_keys file
+// and CA public key a unit's machine agent must keep in sync with the
+// model.
+package keymanager
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/api/base"
+	"github.com/juju/juju/api/watcher"
+	apiwatcher "github.com/juju/juju/apiserver/watcher"
+	"github.com/juju/juju/apiserver/params"
+)
+
+const facadeName = "KeyManager"
+
+// Client provides access to the KeyManager API facade used by machine
+// agents to reconcile ssh access onto units.
+type Client struct {
+	facade base.FacadeCaller
+}
+
+// NewClient returns a Client backed by caller.
+func NewClient(caller base.APICaller) *Client {
+	return &Client{facade: base.NewFacadeCaller(caller, facadeName)}
+}
+
+// AuthorizedKeysFile returns the merged, role-annotated authorized_keys
+// file content for every Juju user with access to the environment. Any
+// user may have been granted access to any unit, so this is the same for
+// every caller.
+func (c *Client) AuthorizedKeysFile() (string, error) {
+	var result params.StringResult
+	if err := c.facade.FacadeCall("AuthorizedKeysFile", nil, &result); err != nil {
+		return "", errors.Trace(err)
+	}
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return result.Result, nil
+}
+
+// WatchAuthorizedKeys returns a watcher that fires whenever any Juju
+// user's authorized keys change.
+func (c *Client) WatchAuthorizedKeys() (watcher.NotifyWatcher, error) {
+	var result params.NotifyWatchResult
+	if err := c.facade.FacadeCall("WatchAuthorizedKeys", nil, &result); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return apiwatcher.NewNotifyWatcher(c.facade.RawAPICaller(), result), nil
+}
+
+// CAPublicKey returns the environment SSH CA's public key, in
+// authorized_keys format, or "" if the environment has not provisioned a
+// CA yet.
+func (c *Client) CAPublicKey() (string, error) {
+	var result params.StringResult
+	if err := c.facade.FacadeCall("CAPublicKey", nil, &result); err != nil {
+		return "", errors.Trace(err)
+	}
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return result.Result, nil
+}
+
+// WatchCAPublicKey returns a watcher that fires whenever the
+// environment's SSH CA document changes - the CA is rotated, or a
+// certificate is revoked.
+func (c *Client) WatchCAPublicKey() (watcher.NotifyWatcher, error) {
+	var result params.NotifyWatchResult
+	if err := c.facade.FacadeCall("WatchCAPublicKey", nil, &result); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return apiwatcher.NewNotifyWatcher(c.facade.RawAPICaller(), result), nil
+}
+
+// RevokedKRL returns the environment SSH CA's current certificate
+// revocation list, in OpenSSH KRL format. An empty result from the facade
+// is returned as an empty, non-nil slice.
+func (c *Client) RevokedKRL() ([]byte, error) {
+	var result params.StringResult
+	if err := c.facade.FacadeCall("RevokedKRL", nil, &result); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return []byte(result.Result), nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keymanager
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// caKeyBits is the size of the RSA keypair generated for a fresh SSH CA.
+const caKeyBits = 4096
+
+// CABacking is the persistence layer the CA operates over: the CA's own
+// keypair, held as a PEM encoded private key, plus the set of serials
+// that have been revoked.
+type CABacking interface {
+	// CAPrivateKey returns the PEM encoded CA private key, or nil if the
+	// environment has not yet provisioned one.
+	CAPrivateKey() ([]byte, error)
+
+	// SetCAPrivateKey persists a newly generated (or rotated) CA private
+	// key.
+	SetCAPrivateKey(pemBytes []byte) error
+
+	// NextCertSerial atomically allocates the next certificate serial
+	// number.
+	NextCertSerial() (uint64, error)
+
+	// RevokedSerials returns every certificate serial that has been
+	// revoked.
+	RevokedSerials() ([]uint64, error)
+
+	// RevokeSerial marks serial as revoked.
+	RevokeSerial(serial uint64) error
+}
+
+// CA issues and manages the short lived SSH user certificates used as an
+// alternative to distributing raw authorized_keys entries.
+type CA struct {
+	store CABacking
+}
+
+// NewCA returns a CA backed by store.
+func NewCA(store CABacking) *CA {
+	return &CA{store: store}
+}
+
+// signer returns the current CA signer, generating and persisting a new
+// keypair the first time it is called for an environment.
+func (ca *CA) signer() (ssh.Signer, error) {
+	pemBytes, err := ca.store.CAPrivateKey()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(pemBytes) == 0 {
+		return ca.Rotate()
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, errors.Annotate(err, "parsing CA private key")
+	}
+	return signer, nil
+}
+
+// Rotate generates a new CA keypair, persists it as the environment's
+// current CA, and returns the corresponding signer. Certificates signed
+// by the previous CA key stop being trusted once units reconcile the new
+// trusted-user-ca-keys file.
+func (ca *CA) Rotate() (ssh.Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, caKeyBits)
+	if err != nil {
+		return nil, errors.Annotate(err, "generating CA keypair")
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err := ca.store.SetCAPrivateKey(pemBytes); err != nil {
+		return nil, errors.Trace(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return signer, nil
+}
+
+// PublicKey returns the CA's public key in authorized_keys format. Machine
+// agents write this into /etc/ssh/trusted-user-ca-keys and reference it
+// from sshd_config's TrustedUserCAKeys option.
+func (ca *CA) PublicKey() (string, error) {
+	signer, err := ca.signer()
+	if err != nil {
+		return "", err
+	}
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
+
+// Sign issues a short lived user certificate for pubKey, restricted to
+// principals and valid for ttl from now.
+func (ca *CA) Sign(pubKey ssh.PublicKey, principals []string, ttl time.Duration) (*ssh.Certificate, error) {
+	if len(principals) == 0 {
+		return nil, errors.New("no principals specified")
+	}
+	signer, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := ca.store.NextCertSerial()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pubKey,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           principals[0],
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, errors.Annotate(err, "signing certificate")
+	}
+	return cert, nil
+}
+
+// Revoke adds serial to the revocation list and returns the updated KRL,
+// ready for distribution to units.
+func (ca *CA) Revoke(serial uint64) ([]byte, error) {
+	if err := ca.store.RevokeSerial(serial); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ca.KRL()
+}
+
+// KRL renders the current set of revoked certificate serials, issued by
+// the current CA key, as an OpenSSH key revocation list, using ssh-keygen
+// since the x/crypto/ssh package does not implement the KRL format.
+func (ca *CA) KRL() ([]byte, error) {
+	serials, err := ca.store.RevokedSerials()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	specFile, err := ioutil.TempFile("", "juju-krl-spec")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.Remove(specFile.Name())
+	for _, serial := range serials {
+		fmt.Fprintf(specFile, "serial: %d\n", serial)
+	}
+	if err := specFile.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// ssh-keygen only accepts serial revocations against a named CA key.
+	signer, err := ca.signer()
+	if err != nil {
+		return nil, err
+	}
+	caKeyPath := specFile.Name() + ".ca.pub"
+	if err := ioutil.WriteFile(caKeyPath, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.Remove(caKeyPath)
+	krlFile, err := ioutil.TempFile("", "juju-krl")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	krlPath := krlFile.Name()
+	krlFile.Close()
+	defer os.Remove(krlPath)
+
+	cmd := exec.Command("ssh-keygen", "-k", "-f", krlPath, "-s", caKeyPath, specFile.Name())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, errors.Annotatef(err, "ssh-keygen -k failed: %s", out)
+	}
+	return ioutil.ReadFile(krlPath)
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keymanager_test
+
+import (
+	"testing"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/juju/juju/apiserver/keymanager"
+	sshtesting "github.com/juju/juju/utils/ssh/testing"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type CASuite struct{}
+
+var _ = gc.Suite(&CASuite{})
+
+// fakeCABacking is an in-memory keymanager.CABacking used to exercise the
+// CA's business logic without standing up a full state.State.
+type fakeCABacking struct {
+	key     []byte
+	serial  uint64
+	revoked []uint64
+}
+
+func (b *fakeCABacking) CAPrivateKey() ([]byte, error) { return b.key, nil }
+
+func (b *fakeCABacking) SetCAPrivateKey(pemBytes []byte) error {
+	b.key = pemBytes
+	return nil
+}
+
+func (b *fakeCABacking) NextCertSerial() (uint64, error) {
+	b.serial++
+	return b.serial, nil
+}
+
+func (b *fakeCABacking) RevokedSerials() ([]uint64, error) { return b.revoked, nil }
+
+func (b *fakeCABacking) RevokeSerial(serial uint64) error {
+	b.revoked = append(b.revoked, serial)
+	return nil
+}
+
+func (s *CASuite) TestRotateGeneratesAndPersistsKey(c *gc.C) {
+	backing := &fakeCABacking{}
+	ca := keymanager.NewCA(backing)
+
+	pubKey, err := ca.PublicKey()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(pubKey, gc.Not(gc.Equals), "")
+	c.Assert(backing.key, gc.Not(gc.HasLen), 0)
+
+	firstKey := backing.key
+	_, err = ca.Rotate()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(backing.key, gc.Not(gc.DeepEquals), firstKey)
+}
+
+func (s *CASuite) TestSignIssuesCertificateForPrincipals(c *gc.C) {
+	backing := &fakeCABacking{}
+	ca := keymanager.NewCA(backing)
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshtesting.ValidKeyOne.Key + " user@host"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	cert, err := ca.Sign(pubKey, []string{"ubuntu", "admin"}, time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cert.ValidPrincipals, gc.DeepEquals, []string{"ubuntu", "admin"})
+	c.Assert(cert.CertType, gc.Equals, uint32(ssh.UserCert))
+	c.Assert(cert.Serial, gc.Equals, uint64(1))
+}
+
+func (s *CASuite) TestSignRejectsNoPrincipals(c *gc.C) {
+	backing := &fakeCABacking{}
+	ca := keymanager.NewCA(backing)
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshtesting.ValidKeyOne.Key + " user@host"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = ca.Sign(pubKey, nil, time.Hour)
+	c.Assert(err, gc.ErrorMatches, "no principals specified")
+}
+
+func (s *CASuite) TestRevokeRecordsSerial(c *gc.C) {
+	backing := &fakeCABacking{}
+	ca := keymanager.NewCA(backing)
+
+	_, err := ca.Revoke(42)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(backing.revoked, gc.DeepEquals, []uint64{42})
+}
@@ -0,0 +1,25 @@
+// Copyright 2013, 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keymanager
+
+import (
+	"bytes"
+	"os/exec"
+
+	"github.com/juju/errors"
+)
+
+// runSSHImportId shells out to the ssh-import-id tool to fetch the keys
+// for a Launchpad user, eg "lp:someuser". The other import schemes are
+// fetched natively by the importers in importer.go.
+func runSSHImportId(keyId string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ssh-import-id", "-o", "-", keyId)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Annotatef(err, "ssh-import-id failed: %s", stderr.String())
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2013, 2014, 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package keymanager implements the API facade used to add, list, delete
+// and import the SSH keys that are authorized to log in to the units of
+// an environment.
+package keymanager
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+
+	jujussh "github.com/juju/juju/utils/ssh"
+)
+
+// keyAlgorithmAndBits returns the algorithm name and, where meaningful,
+// the bit size of the public key in an authorized_keys line. It never
+// fails: a key that does not parse (already reported elsewhere) simply
+// yields an empty algorithm and zero bits.
+func keyAlgorithmAndBits(key string) (string, int) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", 0
+	}
+	algorithm := pubKey.Type()
+	cryptoKey, ok := pubKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return algorithm, 0
+	}
+	switch k := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return algorithm, k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return algorithm, k.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return algorithm, k.P.BitLen()
+	default:
+		return algorithm, 0
+	}
+}
+
+// Role identifies the set of sshd options a key's owner is restricted to
+// once it is rendered into an authorized_keys file by a machine agent.
+type Role string
+
+const (
+	// RoleAdmin grants unrestricted access, equivalent to a key with no
+	// options at all.
+	RoleAdmin Role = "admin"
+
+	// RoleReadonly renders the key with no port, X11 or agent forwarding
+	// and no PTY. The commands run over the key are not restricted.
+	RoleReadonly Role = "readonly"
+)
+
+// Valid reports whether r is one of the known roles, or the zero value
+// (no role requested).
+func (r Role) Valid() bool {
+	switch r {
+	case "", RoleAdmin, RoleReadonly:
+		return true
+	default:
+		return false
+	}
+}
+
+// sshdOptions returns the authorized_keys options string a machine agent
+// should prepend to the key line for the given role. An empty string means
+// no restriction is applied.
+func (r Role) sshdOptions() string {
+	switch r {
+	case RoleReadonly:
+		return "no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty"
+	default:
+		return ""
+	}
+}
+
+// Key records everything the keymanager facade knows about a single
+// authorized key, beyond the raw key material itself.
+type Key struct {
+	// User is the name of the Juju user that owns the key.
+	User string
+
+	// Fingerprint uniquely identifies the key.
+	Fingerprint string
+
+	// Comment is the trailing comment portion of the key, if any.
+	Comment string
+
+	// Algorithm is the key's type, eg "ssh-rsa" or "ssh-ed25519".
+	Algorithm string
+
+	// Bits is the key's size, where that is meaningful for Algorithm (it
+	// is always 0 for, eg, ssh-ed25519 keys).
+	Bits int
+
+	// Source records how the key was added: "add" for keys supplied
+	// directly, or "import:<scheme>:<id>" for keys fetched from an
+	// external provider.
+	Source string
+
+	// Created is when the key was added to the environment.
+	Created time.Time
+
+	// Expires is the time after which the key should no longer be
+	// honoured, or nil if the key does not expire.
+	Expires *time.Time
+
+	// Role controls which sshd options a machine agent renders for this
+	// key when it writes the unit's authorized_keys file.
+	Role Role
+
+	// key is the full "<algo> <key material> <comment>" line.
+	key string
+}
+
+// Expired reports whether the key has an expiry time that has passed.
+func (k Key) Expired(now time.Time) bool {
+	return k.Expires != nil && now.After(*k.Expires)
+}
+
+// AuthorizedKeysLine renders the key as a single line suitable for
+// inclusion in an authorized_keys file, with any role-derived options
+// prepended.
+func (k Key) AuthorizedKeysLine() string {
+	if opts := k.Role.sshdOptions(); opts != "" {
+		return fmt.Sprintf("%s %s", opts, k.key)
+	}
+	return k.key
+}
+
+// KeyManager exposes the per-user authorized key store. The concrete
+// implementation backs onto environment/user state via whatever Backing
+// is supplied; it is kept independent of apiserver/common.Authorizer
+// plumbing here so it can be unit tested directly.
+type KeyManager struct {
+	store Backing
+}
+
+// Backing is the persistence layer a KeyManager operates over. It is
+// satisfied by state.State in production and by fakes in tests.
+type Backing interface {
+	// KeysForUser returns the keys currently recorded for user.
+	KeysForUser(user string) ([]Key, error)
+
+	// AllUserKeys returns every key recorded for every user, keyed by
+	// user name.
+	AllUserKeys() (map[string][]Key, error)
+
+	// SetKeysForUser replaces the full set of keys recorded for user.
+	SetKeysForUser(user string, keys []Key) error
+
+	// KnownUsers returns the names of every user in the store, whether
+	// or not it has any keys on record.
+	KnownUsers() ([]string, error)
+}
+
+// NewKeyManager returns a KeyManager backed by store.
+func NewKeyManager(store Backing) *KeyManager {
+	return &KeyManager{store: store}
+}
+
+// ListKeys returns the keys recorded for the given users. If allUsers is
+// true, users is ignored and keys for every known user are returned.
+func (k *KeyManager) ListKeys(users []string, allUsers bool) (map[string][]Key, error) {
+	if allUsers {
+		return k.store.AllUserKeys()
+	}
+	result := make(map[string][]Key)
+	for _, user := range users {
+		keys, err := k.store.KeysForUser(user)
+		if err != nil {
+			return nil, errors.Annotatef(err, "listing keys for user %q", user)
+		}
+		result[user] = keys
+	}
+	return result, nil
+}
+
+// AddKeyArg describes a single key to be added by AddKeys.
+type AddKeyArg struct {
+	Key     string
+	Role    Role
+	Expires *time.Time
+
+	// source overrides the recorded Source for this key, eg
+	// "import:gh:someuser". Callers outside this package should leave it
+	// unset; AddKeys fills in "add" in that case.
+	source string
+
+	// label, if set, is reported as OpError.Input in place of Key when
+	// this arg is rejected - used by ImportKeys so failures are reported
+	// against the external id that was imported, not the key text it
+	// happened to resolve to.
+	label string
+}
+
+// OpError pairs one of the original inputs to a multi-key operation
+// (AddKeys, DeleteKeys, ImportKeys) with the reason it could not be
+// applied.
+type OpError struct {
+	Input string
+	Err   error
+}
+
+// AddKeys parses and appends newKeys to the set already recorded for
+// user, skipping (and reporting) any that do not parse as a valid SSH
+// public key or duplicate an existing fingerprint.
+func (k *KeyManager) AddKeys(user string, newKeys ...AddKeyArg) ([]OpError, error) {
+	existing, err := k.store.KeysForUser(user)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	seen := make(map[string]bool)
+	for _, key := range existing {
+		seen[key.Fingerprint] = true
+	}
+	var errs []OpError
+	now := time.Now()
+	for _, arg := range newKeys {
+		input := arg.label
+		if input == "" {
+			input = arg.Key
+		}
+		if !arg.Role.Valid() {
+			errs = append(errs, OpError{input, errors.Errorf("invalid role %q", arg.Role)})
+			continue
+		}
+		fingerprint, comment, err := jujussh.KeyFingerprint(arg.Key)
+		if err != nil {
+			errs = append(errs, OpError{input, errors.Annotate(err, "invalid ssh key")})
+			continue
+		}
+		if seen[fingerprint] {
+			errs = append(errs, OpError{input, errors.New("duplicate ssh key")})
+			continue
+		}
+		seen[fingerprint] = true
+		source := arg.source
+		if source == "" {
+			source = "add"
+		}
+		algorithm, bits := keyAlgorithmAndBits(arg.Key)
+		existing = append(existing, Key{
+			User:        user,
+			Fingerprint: fingerprint,
+			Comment:     comment,
+			Algorithm:   algorithm,
+			Bits:        bits,
+			Source:      source,
+			Created:     now,
+			Expires:     arg.Expires,
+			Role:        arg.Role,
+			key:         arg.Key,
+		})
+	}
+	if err := k.store.SetKeysForUser(user, existing); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return errs, nil
+}
+
+// DeleteKeys removes the keys identified by ids (a fingerprint, comment
+// or full key text) from the set recorded for user.
+func (k *KeyManager) DeleteKeys(user string, ids ...string) ([]OpError, error) {
+	existing, err := k.store.KeysForUser(user)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var kept []Key
+	found := make(map[string]bool)
+	for _, key := range existing {
+		switch {
+		case wanted[key.Fingerprint]:
+			found[key.Fingerprint] = true
+		case wanted[key.Comment]:
+			found[key.Comment] = true
+		case wanted[key.key]:
+			found[key.key] = true
+		default:
+			kept = append(kept, key)
+		}
+	}
+	var errs []OpError
+	for _, id := range ids {
+		if !found[id] {
+			errs = append(errs, OpError{id, errors.New("invalid ssh key id")})
+		}
+	}
+	if err := k.store.SetKeysForUser(user, kept); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return errs, nil
+}
+
+// PruneExpired removes every key recorded for user whose expiry time has
+// passed, returning the fingerprints of the keys that were removed.
+func (k *KeyManager) PruneExpired(user string) ([]string, error) {
+	existing, err := k.store.KeysForUser(user)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	now := time.Now()
+	var kept []Key
+	var removed []string
+	for _, key := range existing {
+		if key.Expired(now) {
+			removed = append(removed, key.Fingerprint)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(removed)
+	if err := k.store.SetKeysForUser(user, kept); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return removed, nil
+}
+
+// ImportKeys fetches the keys identified by ids from an external identity
+// source - "lp:<user>", "gh:<user>", "gl:<user>" or a raw "https://" URL -
+// and adds them to the set recorded for user. Source records which
+// provider a key came from, eg "import:gh:someuser".
+func (k *KeyManager) ImportKeys(user string, ids ...string) ([]OpError, error) {
+	var errs []OpError
+	var args []AddKeyArg
+	for _, id := range ids {
+		importer, arg, err := resolveImporter(id)
+		if err != nil {
+			errs = append(errs, OpError{id, err})
+			continue
+		}
+		keyText, err := importer.Import(arg)
+		if err != nil {
+			errs = append(errs, OpError{id, err})
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSpace(keyText), "\n") {
+			if line == "" {
+				continue
+			}
+			args = append(args, AddKeyArg{Key: line, source: "import:" + id, label: id})
+		}
+	}
+	addErrs, err := k.AddKeys(user, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	errs = append(errs, addErrs...)
+	return errs, nil
+}
+
+// AuthorizedKeysFile renders the merged, role-annotated authorized_keys
+// file content for the environment: every non-expired key currently
+// recorded for every Juju user, one per line, with any role-derived sshd
+// options applied. Any Juju user may have been granted access to any
+// unit, so the file worker/authenticationworker reconciles onto each unit
+// is the same for all of them. worker/authenticationworker calls this
+// (via the KeyManager facade) whenever the model's keys change.
+func (k *KeyManager) AuthorizedKeysFile() (string, error) {
+	allKeys, err := k.store.AllUserKeys()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	now := time.Now()
+	var lines []string
+	for _, keys := range allKeys {
+		for _, key := range keys {
+			if key.Expired(now) {
+				continue
+			}
+			lines = append(lines, key.AuthorizedKeysLine())
+		}
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// RunSSHImportId fetches the keys identified by keyId (an ssh-import-id
+// style reference such as "lp:someuser") and returns them as the text of
+// an authorized_keys file. It is a variable so tests can patch in a fake.
+var RunSSHImportId = runSSHImportId
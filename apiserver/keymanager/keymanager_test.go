@@ -0,0 +1,189 @@
+// Copyright 2013, 2014, 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keymanager_test
+
+import (
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju/apiserver/keymanager"
+	sshtesting "github.com/juju/juju/utils/ssh/testing"
+)
+
+type KeyManagerSuite struct{}
+
+var _ = gc.Suite(&KeyManagerSuite{})
+
+// fakeBacking is an in-memory keymanager.Backing used to exercise
+// KeyManager's business logic without standing up a full state.State.
+type fakeBacking struct {
+	keys map[string][]keymanager.Key
+}
+
+func newFakeBacking() *fakeBacking {
+	return &fakeBacking{keys: make(map[string][]keymanager.Key)}
+}
+
+func (b *fakeBacking) KeysForUser(user string) ([]keymanager.Key, error) {
+	return b.keys[user], nil
+}
+
+func (b *fakeBacking) AllUserKeys() (map[string][]keymanager.Key, error) {
+	return b.keys, nil
+}
+
+func (b *fakeBacking) SetKeysForUser(user string, keys []keymanager.Key) error {
+	b.keys[user] = keys
+	return nil
+}
+
+func (b *fakeBacking) KnownUsers() ([]string, error) {
+	var users []string
+	for user := range b.keys {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *KeyManagerSuite) TestDeleteKeyByComment(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
+	_, err := km.AddKeys("admin",
+		keymanager.AddKeyArg{Key: key1},
+		keymanager.AddKeyArg{Key: key2},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+
+	errs, err := km.DeleteKeys("admin", "user@host")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.HasLen, 0)
+
+	remaining, err := km.ListKeys([]string{"admin"}, false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(remaining["admin"], gc.HasLen, 1)
+	c.Assert(remaining["admin"][0].Comment, gc.Equals, "another@host")
+}
+
+func (s *KeyManagerSuite) TestDeleteKeyByFullKeyText(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	_, err := km.AddKeys("admin", keymanager.AddKeyArg{Key: key1})
+	c.Assert(err, jc.ErrorIsNil)
+
+	errs, err := km.DeleteKeys("admin", key1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.HasLen, 0)
+
+	remaining, err := km.ListKeys([]string{"admin"}, false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(remaining["admin"], gc.HasLen, 0)
+}
+
+func (s *KeyManagerSuite) TestDeleteKeyUnknownID(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	_, err := km.AddKeys("admin", keymanager.AddKeyArg{Key: key1})
+	c.Assert(err, jc.ErrorIsNil)
+
+	errs, err := km.DeleteKeys("admin", "not-a-key")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.HasLen, 1)
+	c.Assert(errs[0].Input, gc.Equals, "not-a-key")
+}
+
+func (s *KeyManagerSuite) TestAddKeyRejectsUnknownRole(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+
+	errs, err := km.AddKeys("admin", keymanager.AddKeyArg{Key: key1, Role: keymanager.Role("readony")})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.HasLen, 1)
+	c.Assert(errs[0].Err, gc.ErrorMatches, `invalid role "readony"`)
+
+	remaining, err := km.ListKeys([]string{"admin"}, false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(remaining["admin"], gc.HasLen, 0)
+}
+
+type fakeImporter struct {
+	keys string
+}
+
+func (f fakeImporter) Import(id string) (string, error) {
+	return f.keys, nil
+}
+
+func (s *KeyManagerSuite) TestImportKeysReportsOriginalID(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	keymanager.RegisterImporter("gh", fakeImporter{keys: sshtesting.ValidKeyOne.Key})
+	keymanager.RegisterImporter("gl", fakeImporter{keys: sshtesting.ValidKeyOne.Key})
+	defer func() {
+		keymanager.RegisterImporter("gh", keymanager.NewGitHubImporter())
+		keymanager.RegisterImporter("gl", keymanager.NewGitLabImporter())
+	}()
+
+	// Both ids resolve to the same key, so the second is a genuine
+	// duplicate - it must be reported against "gl:bob", not against the
+	// key text it happened to fetch.
+	errs, err := km.ImportKeys("admin", "gh:bob", "gl:bob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.HasLen, 1)
+	c.Assert(errs[0].Input, gc.Equals, "gl:bob")
+	c.Assert(errs[0].Err, gc.ErrorMatches, "duplicate ssh key")
+}
+
+func (s *KeyManagerSuite) TestAuthorizedKeysFile(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
+	key3 := sshtesting.ValidKeyThree.Key + " bob@host"
+	past := time.Now().Add(-time.Hour)
+	_, err := km.AddKeys("admin",
+		keymanager.AddKeyArg{Key: key1, Role: keymanager.RoleReadonly},
+		keymanager.AddKeyArg{Key: key2, Expires: &past},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = km.AddKeys("bob", keymanager.AddKeyArg{Key: key3})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Any Juju user may have been granted access to a unit, so the
+	// rendered file merges every user's non-expired keys, not just one.
+	content, err := km.AuthorizedKeysFile()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(content, gc.Equals, strings.Join([]string{
+		"no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty " + key1,
+		key3,
+	}, "\n")+"\n")
+}
+
+func (s *KeyManagerSuite) TestPruneExpired(c *gc.C) {
+	backing := newFakeBacking()
+	km := keymanager.NewKeyManager(backing)
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
+	past := time.Now().Add(-time.Hour)
+	_, err := km.AddKeys("admin",
+		keymanager.AddKeyArg{Key: key1, Expires: &past},
+		keymanager.AddKeyArg{Key: key2},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+
+	removed, err := km.PruneExpired("admin")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.DeepEquals, []string{sshtesting.ValidKeyOne.Fingerprint})
+
+	remaining, err := km.ListKeys([]string{"admin"}, false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(remaining["admin"], gc.HasLen, 1)
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package keymanager
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/state"
+)
+
+// NewStateBacking is the production Backing constructor; tests patch it
+// out to avoid standing up a full state.State.
+var NewStateBacking = newStateBacking
+
+func newStateBacking(st *state.State) Backing {
+	return &stateBacking{st}
+}
+
+// stateBacking persists per-user authorized keys through state.User, as
+// one document per key keyed by the owning user and the key's
+// fingerprint.
+//
+// state.User deals only in state.AuthorizedKeyDoc, a plain persistence
+// type owned by package state: the facade's own Key type can't be
+// threaded through state.User's methods, since state can't import
+// apiserver/keymanager without creating an import cycle. stateBacking's
+// job is exactly this translation.
+type stateBacking struct {
+	st *state.State
+}
+
+func keyFromDoc(doc state.AuthorizedKeyDoc) Key {
+	return Key{
+		User:        doc.User,
+		Fingerprint: doc.Fingerprint,
+		Comment:     doc.Comment,
+		Algorithm:   doc.Algorithm,
+		Bits:        doc.Bits,
+		Source:      doc.Source,
+		Created:     doc.Created,
+		Expires:     doc.Expires,
+		Role:        Role(doc.Role),
+		key:         doc.Key,
+	}
+}
+
+func docFromKey(k Key) state.AuthorizedKeyDoc {
+	return state.AuthorizedKeyDoc{
+		User:        k.User,
+		Fingerprint: k.Fingerprint,
+		Comment:     k.Comment,
+		Algorithm:   k.Algorithm,
+		Bits:        k.Bits,
+		Source:      k.Source,
+		Created:     k.Created,
+		Expires:     k.Expires,
+		Role:        string(k.Role),
+		Key:         k.key,
+	}
+}
+
+func (b *stateBacking) KeysForUser(user string) ([]Key, error) {
+	u, err := b.st.User(user)
+	if err != nil {
+		return nil, errors.Annotatef(err, "looking up user %q", user)
+	}
+	docs := u.AuthorizedKeys()
+	keys := make([]Key, len(docs))
+	for i, doc := range docs {
+		keys[i] = keyFromDoc(doc)
+	}
+	return keys, nil
+}
+
+func (b *stateBacking) AllUserKeys() (map[string][]Key, error) {
+	users, err := b.st.AllUsers()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	result := make(map[string][]Key)
+	for _, u := range users {
+		docs := u.AuthorizedKeys()
+		keys := make([]Key, len(docs))
+		for i, doc := range docs {
+			keys[i] = keyFromDoc(doc)
+		}
+		result[u.Name()] = keys
+	}
+	return result, nil
+}
+
+func (b *stateBacking) SetKeysForUser(user string, keys []Key) error {
+	u, err := b.st.User(user)
+	if err != nil {
+		return errors.Annotatef(err, "looking up user %q", user)
+	}
+	docs := make([]state.AuthorizedKeyDoc, len(keys))
+	for i, key := range keys {
+		docs[i] = docFromKey(key)
+	}
+	return u.SetAuthorizedKeys(docs)
+}
+
+func (b *stateBacking) KnownUsers() ([]string, error) {
+	users, err := b.st.AllUsers()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name()
+	}
+	return names, nil
+}
+
+// NewStateCABacking is the production CABacking constructor; tests patch
+// it out to avoid standing up a full state.State.
+var NewStateCABacking = newStateCABacking
+
+func newStateCABacking(st *state.State) CABacking {
+	return &stateCABacking{st}
+}
+
+// stateCABacking persists the environment's SSH CA keypair and
+// certificate revocation list on the environment's SSHCA document.
+type stateCABacking struct {
+	st *state.State
+}
+
+func (b *stateCABacking) CAPrivateKey() ([]byte, error) {
+	ca, err := b.st.SSHCA()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ca.PrivateKey(), nil
+}
+
+func (b *stateCABacking) SetCAPrivateKey(pemBytes []byte) error {
+	ca, err := b.st.SSHCA()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return ca.SetPrivateKey(pemBytes)
+}
+
+func (b *stateCABacking) NextCertSerial() (uint64, error) {
+	ca, err := b.st.SSHCA()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return ca.NextCertSerial()
+}
+
+func (b *stateCABacking) RevokedSerials() ([]uint64, error) {
+	ca, err := b.st.SSHCA()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ca.RevokedSerials(), nil
+}
+
+func (b *stateCABacking) RevokeSerial(serial uint64) error {
+	ca, err := b.st.SSHCA()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return ca.RevokeSerial(serial)
+}
@@ -0,0 +1,23 @@
+// Copyright 2013, 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package testing provides fakes for the external services the
+// apiserver/keymanager package talks to, for use by other packages'
+// tests.
+package testing
+
+import (
+	"github.com/juju/errors"
+
+	sshtesting "github.com/juju/juju/utils/ssh/testing"
+)
+
+// FakeImport is a drop in replacement for keymanager.RunSSHImportId that
+// recognises a single well known id, "lp:validuser", and fails for
+// everything else.
+func FakeImport(keyId string) (string, error) {
+	if keyId == "lp:validuser" {
+		return sshtesting.ValidKeyThree.Key, nil
+	}
+	return "", errors.Errorf("cannot import ssh key id %q", keyId)
+}
@@ -0,0 +1,484 @@
+// Copyright 2013, 2014, 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/juju/apiserver/keymanager"
+	"github.com/juju/juju/cmd/envcmd"
+	"github.com/juju/juju/cmd/juju/block"
+	"github.com/juju/juju/juju"
+)
+
+const authKeysDoc = `
+"juju authorized-keys" is used to manage the ssh keys allowed to log in to
+the machines of an environment on a per Juju user basis.
+`
+
+// NewAuthorizedKeysCommand returns a command that can list, add, delete
+// and import ssh keys, and prune expired ones.
+func NewAuthorizedKeysCommand() cmd.Command {
+	sshkeyscmd := cmd.NewSuperCommand(
+		cmd.SuperCommandParams{
+			Name:    "authorized-keys",
+			Doc:     authKeysDoc,
+			Purpose: "manage authorized ssh keys",
+		})
+	sshkeyscmd.Register(newListKeysCommand())
+	sshkeyscmd.Register(newAddKeysCommand())
+	sshkeyscmd.Register(newDeleteKeysCommand())
+	sshkeyscmd.Register(newImportKeysCommand())
+	sshkeyscmd.Register(newPruneKeysCommand())
+	sshkeyscmd.Register(newCACommand())
+	return sshkeyscmd
+}
+
+// keysBase factors out the bits every authorized-keys sub command needs:
+// an environment to talk to and the user whose keys it operates on.
+type keysBase struct {
+	envcmd.EnvCommandBase
+	user string
+}
+
+func (c *keysBase) getKeyManagerClient() (*keymanager.KeyManager, error) {
+	conn, err := juju.NewConnFromName(c.ConnectionName())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return keymanager.NewKeyManager(keymanager.NewStateBacking(conn.State)), nil
+}
+
+// SetFlags implements cmd.Command.SetFlags.
+func (c *keysBase) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.user, "user", "admin", "the user for which to manage keys")
+}
+
+// opResult is the structured, per-input outcome of a mutating
+// authorized-keys command (add, delete, import), so callers can tell
+// which of several inputs failed without scraping stderr.
+type opResult struct {
+	Input  string `json:"input" yaml:"input"`
+	Status string `json:"status" yaml:"status"`
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// buildOpResults pairs every input with either the failure reported for
+// it in errs, or successStatus if it was applied cleanly.
+func buildOpResults(inputs []string, errs []keymanager.OpError, successStatus string) []opResult {
+	failed := make(map[string]error, len(errs))
+	for _, opErr := range errs {
+		failed[opErr.Input] = opErr.Err
+	}
+	results := make([]opResult, len(inputs))
+	for i, input := range inputs {
+		if err, ok := failed[input]; ok {
+			results[i] = opResult{Input: input, Status: "error", Error: err.Error()}
+			continue
+		}
+		results[i] = opResult{Input: input, Status: successStatus}
+	}
+	return results
+}
+
+// formatOpResultsTabular returns a tabular cmd.Formatter for []opResult
+// that reports only the failures, in the traditional
+// `cannot <label> "<input>": <reason>` form; successes are silent.
+func formatOpResultsTabular(label string) cmd.Formatter {
+	return func(value interface{}) ([]byte, error) {
+		results, ok := value.([]opResult)
+		if !ok {
+			return nil, errors.Errorf("expected value of type []opResult, got %T", value)
+		}
+		var out strings.Builder
+		for _, r := range results {
+			if r.Status != "error" {
+				continue
+			}
+			fmt.Fprintf(&out, "cannot %s %q: %s\n", label, r.Input, r.Error)
+		}
+		return []byte(out.String()), nil
+	}
+}
+
+// -----------------------------------------------------------------------
+// list
+
+var listKeysDoc = `
+List the ssh keys authorized for this environment.
+`
+
+type listKeysCommand struct {
+	keysBase
+	allUsers bool
+	full     bool
+	out      cmd.Output
+}
+
+func newListKeysCommand() cmd.Command {
+	return envcmd.Wrap(&listKeysCommand{})
+}
+
+func (c *listKeysCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "list",
+		Purpose: "list authorized ssh keys",
+		Doc:     listKeysDoc,
+	}
+}
+
+func (c *listKeysCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.keysBase.SetFlags(f)
+	f.BoolVar(&c.full, "full", false, "show the full key instead of just the fingerprint")
+	f.BoolVar(&c.allUsers, "all-users", false, "list keys for every user")
+	c.out.AddFlags(f, "tabular", map[string]cmd.Formatter{
+		"tabular": formatKeysTabular,
+		"json":    cmd.FormatJson,
+		"yaml":    cmd.FormatYaml,
+	})
+}
+
+func (c *listKeysCommand) Init(args []string) error {
+	return cmd.CheckEmpty(args)
+}
+
+func (c *listKeysCommand) Run(ctx *cmd.Context) error {
+	client, err := c.getKeyManagerClient()
+	if err != nil {
+		return err
+	}
+	var users []string
+	if !c.allUsers {
+		users = []string{c.user}
+	}
+	keys, err := client.ListKeys(users, c.allUsers)
+	if err != nil {
+		return err
+	}
+	return c.out.Write(ctx, keysToRecords(keys, c.full))
+}
+
+// keyRecord is the structured representation of a single key, used by
+// every non tabular output format.
+type keyRecord struct {
+	User        string `json:"user" yaml:"user"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+	Comment     string `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Algorithm   string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	Bits        int    `json:"bits,omitempty" yaml:"bits,omitempty"`
+	Source      string `json:"source" yaml:"source"`
+	Role        string `json:"role,omitempty" yaml:"role,omitempty"`
+	Added       string `json:"added" yaml:"added"`
+	Expires     string `json:"expires,omitempty" yaml:"expires,omitempty"`
+
+	// display is what the tabular formatter prints for the key itself:
+	// the fingerprint, or the full key text if --full was given. It is
+	// unexported so it never leaks into the json/yaml output.
+	display string
+}
+
+func keysToRecords(keys map[string][]keymanager.Key, full bool) []keyRecord {
+	var users []string
+	for user := range keys {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	var records []keyRecord
+	for _, user := range users {
+		for _, k := range keys[user] {
+			display := k.Fingerprint
+			if full {
+				display = k.AuthorizedKeysLine()
+			}
+			rec := keyRecord{
+				User:        user,
+				Fingerprint: k.Fingerprint,
+				Comment:     k.Comment,
+				Algorithm:   k.Algorithm,
+				Bits:        k.Bits,
+				Source:      k.Source,
+				Role:        string(k.Role),
+				Added:       k.Created.Format(time.RFC3339),
+				display:     display,
+			}
+			if k.Expires != nil {
+				rec.Expires = k.Expires.Format(time.RFC3339)
+			}
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func formatKeysTabular(value interface{}) ([]byte, error) {
+	records, ok := value.([]keyRecord)
+	if !ok {
+		return nil, errors.Errorf("expected value of type []keyRecord, got %T", value)
+	}
+	var out strings.Builder
+	byUser := make(map[string][]keyRecord)
+	var users []string
+	for _, r := range records {
+		if _, ok := byUser[r.User]; !ok {
+			users = append(users, r.User)
+		}
+		byUser[r.User] = append(byUser[r.User], r)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		fmt.Fprintf(&out, "Keys for user %s:\n", user)
+		for _, r := range byUser[user] {
+			line := r.display
+			if r.Comment != "" && r.display == r.Fingerprint {
+				line = fmt.Sprintf("%s (%s)", line, r.Comment)
+			}
+			if r.Role != "" {
+				line = fmt.Sprintf("%s [%s]", line, r.Role)
+			}
+			fmt.Fprintln(&out, line)
+		}
+	}
+	return []byte(out.String()), nil
+}
+
+// -----------------------------------------------------------------------
+// add
+
+var addKeysDoc = `
+Add new authorized ssh keys for the specified Juju user.
+`
+
+type addKeysCommand struct {
+	keysBase
+	sshKeys []string
+	role    string
+	expires string
+	out     cmd.Output
+}
+
+func newAddKeysCommand() cmd.Command {
+	return envcmd.Wrap(&addKeysCommand{})
+}
+
+func (c *addKeysCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "add",
+		Args:    "<ssh key> [...]",
+		Purpose: "add new authorized ssh keys for a user",
+		Doc:     addKeysDoc,
+	}
+}
+
+func (c *addKeysCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.keysBase.SetFlags(f)
+	f.StringVar(&c.role, "role", "", "role to apply to the key (admin, readonly)")
+	f.StringVar(&c.expires, "expires", "", "duration after which the key expires, eg 24h")
+	c.out.AddFlags(f, "tabular", map[string]cmd.Formatter{
+		"tabular": formatOpResultsTabular("add key"),
+		"json":    cmd.FormatJson,
+		"yaml":    cmd.FormatYaml,
+	})
+}
+
+func (c *addKeysCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no ssh key specified")
+	}
+	c.sshKeys = args
+	return nil
+}
+
+func (c *addKeysCommand) Run(ctx *cmd.Context) error {
+	role := keymanager.Role(c.role)
+	if !role.Valid() {
+		return errors.Errorf("invalid --role value %q", c.role)
+	}
+	var expires *time.Time
+	if c.expires != "" {
+		d, err := time.ParseDuration(c.expires)
+		if err != nil {
+			return errors.Annotatef(err, "invalid --expires value %q", c.expires)
+		}
+		t := time.Now().Add(d)
+		expires = &t
+	}
+	client, err := c.getKeyManagerClient()
+	if err != nil {
+		return err
+	}
+	var args []keymanager.AddKeyArg
+	for _, key := range c.sshKeys {
+		args = append(args, keymanager.AddKeyArg{
+			Key:     key,
+			Role:    role,
+			Expires: expires,
+		})
+	}
+	errs, err := client.AddKeys(c.user, args...)
+	if err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	return c.out.Write(ctx, buildOpResults(c.sshKeys, errs, "added"))
+}
+
+// -----------------------------------------------------------------------
+// delete
+
+var deleteKeysDoc = `
+Delete existing authorized ssh keys for the specified Juju user.
+`
+
+type deleteKeysCommand struct {
+	keysBase
+	keyIds []string
+	out    cmd.Output
+}
+
+func newDeleteKeysCommand() cmd.Command {
+	return envcmd.Wrap(&deleteKeysCommand{})
+}
+
+func (c *deleteKeysCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "delete",
+		Args:    "<ssh key id> [...]",
+		Purpose: "delete authorized ssh keys for a user",
+		Doc:     deleteKeysDoc,
+	}
+}
+
+func (c *deleteKeysCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.keysBase.SetFlags(f)
+	c.out.AddFlags(f, "tabular", map[string]cmd.Formatter{
+		"tabular": formatOpResultsTabular("delete key id"),
+		"json":    cmd.FormatJson,
+		"yaml":    cmd.FormatYaml,
+	})
+}
+
+func (c *deleteKeysCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no ssh key id specified")
+	}
+	c.keyIds = args
+	return nil
+}
+
+func (c *deleteKeysCommand) Run(ctx *cmd.Context) error {
+	client, err := c.getKeyManagerClient()
+	if err != nil {
+		return err
+	}
+	errs, err := client.DeleteKeys(c.user, c.keyIds...)
+	if err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	return c.out.Write(ctx, buildOpResults(c.keyIds, errs, "deleted"))
+}
+
+// -----------------------------------------------------------------------
+// import
+
+var importKeysDoc = `
+Import new authorized ssh keys for the specified Juju user from a trusted
+identity source, eg "lp:someuser" or "gh:someuser".
+`
+
+type importKeysCommand struct {
+	keysBase
+	keyIds []string
+	out    cmd.Output
+}
+
+func newImportKeysCommand() cmd.Command {
+	return envcmd.Wrap(&importKeysCommand{})
+}
+
+func (c *importKeysCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "import",
+		Args:    "<ssh key id> [...]",
+		Purpose: "import new authorized ssh keys for a user",
+		Doc:     importKeysDoc,
+	}
+}
+
+func (c *importKeysCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.keysBase.SetFlags(f)
+	c.out.AddFlags(f, "tabular", map[string]cmd.Formatter{
+		"tabular": formatOpResultsTabular("import key id"),
+		"json":    cmd.FormatJson,
+		"yaml":    cmd.FormatYaml,
+	})
+}
+
+func (c *importKeysCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no ssh key id specified")
+	}
+	c.keyIds = args
+	return nil
+}
+
+func (c *importKeysCommand) Run(ctx *cmd.Context) error {
+	client, err := c.getKeyManagerClient()
+	if err != nil {
+		return err
+	}
+	errs, err := client.ImportKeys(c.user, c.keyIds...)
+	if err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	return c.out.Write(ctx, buildOpResults(c.keyIds, errs, "imported"))
+}
+
+// -----------------------------------------------------------------------
+// prune
+
+var pruneKeysDoc = `
+Remove any authorized ssh keys for the specified Juju user that have
+passed their expiry time.
+`
+
+type pruneKeysCommand struct {
+	keysBase
+}
+
+func newPruneKeysCommand() cmd.Command {
+	return envcmd.Wrap(&pruneKeysCommand{})
+}
+
+func (c *pruneKeysCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "prune",
+		Purpose: "remove expired authorized ssh keys",
+		Doc:     pruneKeysDoc,
+	}
+}
+
+func (c *pruneKeysCommand) Init(args []string) error {
+	return cmd.CheckEmpty(args)
+}
+
+func (c *pruneKeysCommand) Run(ctx *cmd.Context) error {
+	client, err := c.getKeyManagerClient()
+	if err != nil {
+		return err
+	}
+	removed, err := client.PruneExpired(c.user)
+	if err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	for _, fingerprint := range removed {
+		fmt.Fprintf(ctx.Stdout, "removed expired key %s\n", fingerprint)
+	}
+	return nil
+}
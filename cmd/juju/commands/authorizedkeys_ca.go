@@ -0,0 +1,232 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/juju/apiserver/keymanager"
+	"github.com/juju/juju/cmd/envcmd"
+	"github.com/juju/juju/cmd/juju/block"
+	"github.com/juju/juju/juju"
+)
+
+const caDoc = `
+"juju authorized-keys ca" manages an environment running in SSH CA mode,
+where sshd trusts short lived certificates signed by the environment's own
+CA instead of (or alongside) individual authorized_keys entries.
+`
+
+// newCACommand returns the "ca" sub-supercommand, nested under
+// authorized-keys: sign, rotate, revoke.
+func newCACommand() cmd.Command {
+	cacmd := cmd.NewSuperCommand(
+		cmd.SuperCommandParams{
+			Name:    "ca",
+			Doc:     caDoc,
+			Purpose: "manage the environment's SSH CA",
+		})
+	cacmd.Register(newCASignCommand())
+	cacmd.Register(newCARotateCommand())
+	cacmd.Register(newCARevokeCommand())
+	return cacmd
+}
+
+// caBase factors out the environment connection shared by the ca
+// sub commands; unlike the plain key commands, CA operations are not
+// scoped to a single Juju user.
+type caBase struct {
+	envcmd.EnvCommandBase
+}
+
+func (c *caBase) getCA() (*keymanager.CA, error) {
+	conn, err := juju.NewConnFromName(c.ConnectionName())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return keymanager.NewCA(keymanager.NewStateCABacking(conn.State)), nil
+}
+
+// -----------------------------------------------------------------------
+// sign
+
+var caSignDoc = `
+Request a short lived SSH user certificate signed by the environment's CA,
+written next to the public key and usable with "ssh -i".
+`
+
+type caSignCommand struct {
+	caBase
+	principals string
+	ttl        time.Duration
+	pubKeyPath string
+}
+
+func newCASignCommand() cmd.Command {
+	return envcmd.Wrap(&caSignCommand{})
+}
+
+func (c *caSignCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "sign",
+		Purpose: "obtain a CA signed ssh certificate",
+		Doc:     caSignDoc,
+	}
+}
+
+func (c *caSignCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.principals, "principals", "ubuntu", "comma separated list of principals the certificate is valid for")
+	f.DurationVar(&c.ttl, "ttl", time.Hour, "how long the certificate remains valid")
+	f.StringVar(&c.pubKeyPath, "public-key", "~/.ssh/id_rsa.pub", "public key to certify")
+}
+
+func (c *caSignCommand) Init(args []string) error {
+	return cmd.CheckEmpty(args)
+}
+
+func (c *caSignCommand) Run(ctx *cmd.Context) error {
+	path := c.pubKeyPath
+	if home, err := os.UserHomeDir(); err == nil {
+		path = strings.Replace(path, "~", home, 1)
+	}
+	pubKeyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Annotatef(err, "reading public key %q", path)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return errors.Annotatef(err, "parsing public key %q", path)
+	}
+	ca, err := c.getCA()
+	if err != nil {
+		return err
+	}
+	principals := strings.Split(c.principals, ",")
+	cert, err := ca.Sign(pubKey, principals, c.ttl)
+	if err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	certPath := strings.TrimSuffix(path, ".pub") + "-cert.pub"
+	certLine := ssh.MarshalAuthorizedKey(cert)
+	if err := ioutil.WriteFile(certPath, certLine, 0644); err != nil {
+		return errors.Annotatef(err, "writing certificate %q", certPath)
+	}
+	privKeyPath := strings.TrimSuffix(path, ".pub")
+	fmt.Fprintf(ctx.Stdout, "certificate written to %s\n", certPath)
+	fmt.Fprintf(ctx.Stdout, "ssh -i %s %s@<host>\n", privKeyPath, principals[0])
+	return nil
+}
+
+// -----------------------------------------------------------------------
+// rotate
+
+var caRotateDoc = `
+Generate a new CA keypair for the environment. Existing certificates
+signed by the previous CA stop being trusted once machine agents
+reconcile the new CA public key into /etc/ssh/trusted-user-ca-keys.
+`
+
+type caRotateCommand struct {
+	caBase
+}
+
+func newCARotateCommand() cmd.Command {
+	return envcmd.Wrap(&caRotateCommand{})
+}
+
+func (c *caRotateCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "rotate",
+		Purpose: "rotate the environment's SSH CA keypair",
+		Doc:     caRotateDoc,
+	}
+}
+
+func (c *caRotateCommand) Init(args []string) error {
+	return cmd.CheckEmpty(args)
+}
+
+func (c *caRotateCommand) Run(ctx *cmd.Context) error {
+	ca, err := c.getCA()
+	if err != nil {
+		return err
+	}
+	if _, err := ca.Rotate(); err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	pubKey, err := ca.PublicKey()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(ctx.Stdout, pubKey)
+	return nil
+}
+
+// -----------------------------------------------------------------------
+// revoke
+
+var caRevokeDoc = `
+Revoke a previously issued certificate by serial number and print the
+updated key revocation list (KRL) for distribution to units.
+`
+
+type caRevokeCommand struct {
+	caBase
+	serial uint64
+	output string
+}
+
+func newCARevokeCommand() cmd.Command {
+	return envcmd.Wrap(&caRevokeCommand{})
+}
+
+func (c *caRevokeCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "revoke",
+		Args:    "<certificate serial>",
+		Purpose: "revoke a CA signed ssh certificate",
+		Doc:     caRevokeDoc,
+	}
+}
+
+func (c *caRevokeCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.output, "output", "", "file to write the updated KRL to, instead of stdout")
+}
+
+func (c *caRevokeCommand) Init(args []string) error {
+	if len(args) != 1 {
+		return errors.New("exactly one certificate serial must be specified")
+	}
+	var serial uint64
+	if _, err := fmt.Sscanf(args[0], "%d", &serial); err != nil {
+		return errors.Errorf("invalid certificate serial %q", args[0])
+	}
+	c.serial = serial
+	return nil
+}
+
+func (c *caRevokeCommand) Run(ctx *cmd.Context) error {
+	ca, err := c.getCA()
+	if err != nil {
+		return err
+	}
+	krl, err := ca.Revoke(c.serial)
+	if err != nil {
+		return block.ProcessBlockedError(err, block.BlockChange)
+	}
+	if c.output == "" {
+		_, err = ctx.Stdout.Write(krl)
+		return err
+	}
+	return ioutil.WriteFile(ctx.AbsPath(c.output), krl, 0644)
+}
@@ -4,8 +4,10 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
@@ -27,10 +29,12 @@ var _ = gc.Suite(&AuthorizedKeysSuite{})
 
 var authKeysCommandNames = []string{
 	"add",
+	"ca",
 	"delete",
 	"help",
 	"import",
 	"list",
+	"prune",
 }
 
 func (s *AuthorizedKeysSuite) TestHelpCommands(c *gc.C) {
@@ -81,6 +85,12 @@ func (s *AuthorizedKeysSuite) TestHelpImport(c *gc.C) {
 	s.assertHelpOutput(c, "import", "<ssh key id> [...]")
 }
 
+func (s *AuthorizedKeysSuite) TestHelpCA(c *gc.C) {
+	out := badrun(c, 0, "authorized-keys", "ca", "--help")
+	lines := strings.Split(out, "\n")
+	c.Assert(lines[0], gc.Equals, "usage: juju authorized-keys ca <command> ...")
+}
+
 type keySuiteBase struct {
 	jujutesting.JujuConnSuite
 	CmdBlockHelper
@@ -98,20 +108,35 @@ func (s *keySuiteBase) SetUpTest(c *gc.C) {
 	s.AddCleanup(func(*gc.C) { s.CmdBlockHelper.Close() })
 }
 
+func (s *keySuiteBase) keyManager() *keymanagerserver.KeyManager {
+	return keymanagerserver.NewKeyManager(keymanagerserver.NewStateBacking(s.State))
+}
+
 func (s *keySuiteBase) setAuthorizedKeys(c *gc.C, keys ...string) {
-	keyString := strings.Join(keys, "\n")
-	err := s.State.UpdateEnvironConfig(map[string]interface{}{"authorized-keys": keyString}, nil, nil)
-	c.Assert(err, jc.ErrorIsNil)
-	envConfig, err := s.State.EnvironConfig()
+	s.setAuthorizedKeysForUser(c, "admin", keys...)
+}
+
+func (s *keySuiteBase) setAuthorizedKeysForUser(c *gc.C, user string, keys ...string) {
+	var args []keymanagerserver.AddKeyArg
+	for _, key := range keys {
+		args = append(args, keymanagerserver.AddKeyArg{Key: key})
+	}
+	_, err := s.keyManager().AddKeys(user, args...)
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(envConfig.AuthorizedKeys(), gc.Equals, keyString)
 }
 
 func (s *keySuiteBase) assertEnvironKeys(c *gc.C, expected ...string) {
-	envConfig, err := s.State.EnvironConfig()
+	s.assertUserKeys(c, "admin", expected...)
+}
+
+func (s *keySuiteBase) assertUserKeys(c *gc.C, user string, expected ...string) {
+	keys, err := s.keyManager().ListKeys([]string{user}, false)
 	c.Assert(err, jc.ErrorIsNil)
-	keys := envConfig.AuthorizedKeys()
-	c.Assert(keys, gc.Equals, strings.Join(expected, "\n"))
+	var lines []string
+	for _, key := range keys[user] {
+		lines = append(lines, key.AuthorizedKeysLine())
+	}
+	c.Assert(lines, gc.DeepEquals, expected)
 }
 
 type ListKeysSuite struct {
@@ -125,11 +150,21 @@ func (s *ListKeysSuite) TestListKeys(c *gc.C) {
 	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
 	s.setAuthorizedKeys(c, key1, key2)
 
-	context, err := coretesting.RunCommand(c, newListKeysCommand())
+	context, err := coretesting.RunCommand(c, newListKeysCommand(), "--format", "json")
 	c.Assert(err, jc.ErrorIsNil)
-	output := strings.TrimSpace(coretesting.Stdout(context))
-	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(output, gc.Matches, "Keys for user admin:\n.*\\(user@host\\)\n.*\\(another@host\\)")
+
+	var records []keyRecord
+	c.Assert(json.Unmarshal([]byte(coretesting.Stdout(context)), &records), jc.ErrorIsNil)
+	c.Assert(records, gc.HasLen, 2)
+	c.Assert(records[0].User, gc.Equals, "admin")
+	c.Assert(records[0].Fingerprint, gc.Equals, sshtesting.ValidKeyOne.Fingerprint)
+	c.Assert(records[0].Comment, gc.Equals, "user@host")
+	c.Assert(records[0].Algorithm, gc.Equals, "ssh-rsa")
+	c.Assert(records[0].Bits, gc.Not(gc.Equals), 0)
+	c.Assert(records[0].Source, gc.Equals, "add")
+	c.Assert(records[0].Added, gc.Not(gc.Equals), "")
+	c.Assert(records[1].Fingerprint, gc.Equals, sshtesting.ValidKeyTwo.Fingerprint)
+	c.Assert(records[1].Comment, gc.Equals, "another@host")
 }
 
 func (s *ListKeysSuite) TestListFullKeys(c *gc.C) {
@@ -147,8 +182,8 @@ func (s *ListKeysSuite) TestListFullKeys(c *gc.C) {
 func (s *ListKeysSuite) TestListKeysNonDefaultUser(c *gc.C) {
 	key1 := sshtesting.ValidKeyOne.Key + " user@host"
 	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
-	s.setAuthorizedKeys(c, key1, key2)
 	s.Factory.MakeUser(c, &factory.UserParams{Name: "fred"})
+	s.setAuthorizedKeysForUser(c, "fred", key1, key2)
 
 	context, err := coretesting.RunCommand(c, newListKeysCommand(), "--user", "fred")
 	c.Assert(err, jc.ErrorIsNil)
@@ -173,9 +208,17 @@ func (s *AddKeySuite) TestAddKey(c *gc.C) {
 	s.setAuthorizedKeys(c, key1)
 
 	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
-	context, err := coretesting.RunCommand(c, newAddKeysCommand(), key2, "invalid-key")
+	context, err := coretesting.RunCommand(c, newAddKeysCommand(), "--format", "json", key2, "invalid-key")
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(coretesting.Stderr(context), gc.Matches, `cannot add key "invalid-key".*\n`)
+
+	var results []opResult
+	c.Assert(json.Unmarshal([]byte(coretesting.Stdout(context)), &results), jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(results[0], gc.Equals, opResult{Input: key2, Status: "added"})
+	c.Assert(results[1].Input, gc.Equals, "invalid-key")
+	c.Assert(results[1].Status, gc.Equals, "error")
+	c.Assert(results[1].Error, gc.Not(gc.Equals), "")
+
 	s.assertEnvironKeys(c, key1, key2)
 }
 
@@ -198,8 +241,9 @@ func (s *AddKeySuite) TestAddKeyNonDefaultUser(c *gc.C) {
 	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
 	context, err := coretesting.RunCommand(c, newAddKeysCommand(), "--user", "fred", key2)
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(coretesting.Stderr(context), gc.Equals, "")
-	s.assertEnvironKeys(c, key1, key2)
+	c.Assert(coretesting.Stdout(context), gc.Equals, "")
+	s.assertEnvironKeys(c, key1)
+	s.assertUserKeys(c, "fred", key2)
 }
 
 type DeleteKeySuite struct {
@@ -213,10 +257,18 @@ func (s *DeleteKeySuite) TestDeleteKeys(c *gc.C) {
 	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
 	s.setAuthorizedKeys(c, key1, key2)
 
-	context, err := coretesting.RunCommand(c, newDeleteKeysCommand(),
+	context, err := coretesting.RunCommand(c, newDeleteKeysCommand(), "--format", "json",
 		sshtesting.ValidKeyTwo.Fingerprint, "invalid-key")
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(coretesting.Stderr(context), gc.Matches, `cannot delete key id "invalid-key".*\n`)
+
+	var results []opResult
+	c.Assert(json.Unmarshal([]byte(coretesting.Stdout(context)), &results), jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(results[0], gc.Equals, opResult{Input: sshtesting.ValidKeyTwo.Fingerprint, Status: "deleted"})
+	c.Assert(results[1].Input, gc.Equals, "invalid-key")
+	c.Assert(results[1].Status, gc.Equals, "error")
+	c.Assert(results[1].Error, gc.Not(gc.Equals), "")
+
 	s.assertEnvironKeys(c, key1)
 }
 
@@ -237,12 +289,14 @@ func (s *DeleteKeySuite) TestDeleteKeyNonDefaultUser(c *gc.C) {
 	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
 	s.setAuthorizedKeys(c, key1, key2)
 	s.Factory.MakeUser(c, &factory.UserParams{Name: "fred"})
+	s.setAuthorizedKeysForUser(c, "fred", key2)
 
 	context, err := coretesting.RunCommand(c, newDeleteKeysCommand(),
 		"--user", "fred", sshtesting.ValidKeyTwo.Fingerprint)
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(coretesting.Stderr(context), gc.Equals, "")
-	s.assertEnvironKeys(c, key1)
+	c.Assert(coretesting.Stdout(context), gc.Equals, "")
+	s.assertEnvironKeys(c, key1, key2)
+	s.assertUserKeys(c, "fred")
 }
 
 type ImportKeySuite struct {
@@ -251,18 +305,46 @@ type ImportKeySuite struct {
 
 var _ = gc.Suite(&ImportKeySuite{})
 
+type fakeImporter struct {
+	keys string
+	err  error
+}
+
+func (f fakeImporter) Import(id string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.keys, nil
+}
+
 func (s *ImportKeySuite) SetUpTest(c *gc.C) {
 	s.keySuiteBase.SetUpTest(c)
 	s.PatchValue(&keymanagerserver.RunSSHImportId, keymanagertesting.FakeImport)
+	keymanagerserver.RegisterImporter("gh", fakeImporter{keys: sshtesting.ValidKeyThree.Key})
+	keymanagerserver.RegisterImporter("gl", fakeImporter{keys: sshtesting.ValidKeyThree.Key})
+	keymanagerserver.RegisterImporter("https", fakeImporter{keys: sshtesting.ValidKeyThree.Key})
+	s.AddCleanup(func(*gc.C) {
+		keymanagerserver.RegisterImporter("gh", keymanagerserver.NewGitHubImporter())
+		keymanagerserver.RegisterImporter("gl", keymanagerserver.NewGitLabImporter())
+		keymanagerserver.RegisterImporter("https", keymanagerserver.NewURLImporter())
+	})
 }
 
 func (s *ImportKeySuite) TestImportKeys(c *gc.C) {
 	key1 := sshtesting.ValidKeyOne.Key + " user@host"
 	s.setAuthorizedKeys(c, key1)
 
-	context, err := coretesting.RunCommand(c, newImportKeysCommand(), "lp:validuser", "invalid-key")
+	context, err := coretesting.RunCommand(c, newImportKeysCommand(), "--format", "json", "lp:validuser", "invalid-key")
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(coretesting.Stderr(context), gc.Matches, `cannot import key id "invalid-key".*\n`)
+
+	var results []opResult
+	c.Assert(json.Unmarshal([]byte(coretesting.Stdout(context)), &results), jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(results[0], gc.Equals, opResult{Input: "lp:validuser", Status: "imported"})
+	c.Assert(results[1].Input, gc.Equals, "invalid-key")
+	c.Assert(results[1].Status, gc.Equals, "error")
+	c.Assert(results[1].Error, gc.Not(gc.Equals), "")
+
 	s.assertEnvironKeys(c, key1, sshtesting.ValidKeyThree.Key)
 }
 
@@ -283,6 +365,95 @@ func (s *ImportKeySuite) TestImportKeyNonDefaultUser(c *gc.C) {
 
 	context, err := coretesting.RunCommand(c, newImportKeysCommand(), "--user", "fred", "lp:validuser")
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(coretesting.Stderr(context), gc.Equals, "")
-	s.assertEnvironKeys(c, key1, sshtesting.ValidKeyThree.Key)
+	c.Assert(coretesting.Stdout(context), gc.Equals, "")
+	s.assertEnvironKeys(c, key1)
+	s.assertUserKeys(c, "fred", sshtesting.ValidKeyThree.Key)
+}
+
+func (s *ImportKeySuite) TestImportKeysFromGitHubGitLabAndURL(c *gc.C) {
+	// All three fakes resolve to the same key, so only the first import
+	// actually adds anything; the rest are reported as duplicates.
+	context, err := coretesting.RunCommand(c, newImportKeysCommand(), "--format", "json",
+		"gh:validuser", "gl:validuser", "https://example.com/validuser.keys")
+	c.Assert(err, jc.ErrorIsNil)
+
+	var results []opResult
+	c.Assert(json.Unmarshal([]byte(coretesting.Stdout(context)), &results), jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 3)
+	c.Assert(results[0], gc.Equals, opResult{Input: "gh:validuser", Status: "imported"})
+	c.Assert(results[1].Status, gc.Equals, "error")
+	c.Assert(results[1].Error, gc.Matches, ".*duplicate ssh key.*")
+	c.Assert(results[2].Status, gc.Equals, "error")
+	c.Assert(results[2].Error, gc.Matches, ".*duplicate ssh key.*")
+
+	s.assertEnvironKeys(c, sshtesting.ValidKeyThree.Key)
+}
+
+func (s *ImportKeySuite) TestImportKeysUnrecognisedScheme(c *gc.C) {
+	context, err := coretesting.RunCommand(c, newImportKeysCommand(), "--format", "json", "ftp:validuser")
+	c.Assert(err, jc.ErrorIsNil)
+
+	var results []opResult
+	c.Assert(json.Unmarshal([]byte(coretesting.Stdout(context)), &results), jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].Input, gc.Equals, "ftp:validuser")
+	c.Assert(results[0].Status, gc.Equals, "error")
+	c.Assert(results[0].Error, gc.Matches, ".*unrecognised ssh key import id.*")
+}
+
+func (s *AddKeySuite) TestAddKeyWithRoleAndExpiry(c *gc.C) {
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+
+	context, err := coretesting.RunCommand(c, newAddKeysCommand(),
+		"--role", "readonly", "--expires", "1h", key1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(coretesting.Stdout(context), gc.Equals, "")
+
+	keys, err := s.keyManager().ListKeys([]string{"admin"}, false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(keys["admin"], gc.HasLen, 1)
+	added := keys["admin"][0]
+	c.Assert(added.Role, gc.Equals, keymanagerserver.RoleReadonly)
+	c.Assert(added.Expires, gc.NotNil)
+}
+
+type ListAllUsersKeysSuite struct {
+	keySuiteBase
+}
+
+var _ = gc.Suite(&ListAllUsersKeysSuite{})
+
+func (s *ListAllUsersKeysSuite) TestListAllUsers(c *gc.C) {
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
+	s.setAuthorizedKeys(c, key1)
+	s.Factory.MakeUser(c, &factory.UserParams{Name: "fred"})
+	s.setAuthorizedKeysForUser(c, "fred", key2)
+
+	context, err := coretesting.RunCommand(c, newListKeysCommand(), "--all-users")
+	c.Assert(err, jc.ErrorIsNil)
+	output := strings.TrimSpace(coretesting.Stdout(context))
+	c.Assert(output, gc.Matches, "(?s).*Keys for user admin:.*")
+	c.Assert(output, gc.Matches, "(?s).*Keys for user fred:.*")
+}
+
+type PruneKeysSuite struct {
+	keySuiteBase
+}
+
+var _ = gc.Suite(&PruneKeysSuite{})
+
+func (s *PruneKeysSuite) TestPruneExpired(c *gc.C) {
+	key1 := sshtesting.ValidKeyOne.Key + " user@host"
+	key2 := sshtesting.ValidKeyTwo.Key + " another@host"
+	past := time.Now().Add(-time.Hour)
+	_, err := s.keyManager().AddKeys("admin",
+		keymanagerserver.AddKeyArg{Key: key1, Expires: &past},
+		keymanagerserver.AddKeyArg{Key: key2},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = coretesting.RunCommand(c, newPruneKeysCommand())
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertEnvironKeys(c, key2)
 }
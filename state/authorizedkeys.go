@@ -0,0 +1,92 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// authorizedKeysC holds one document per authorized key, keyed by the
+// owning user and the key's fingerprint.
+const authorizedKeysC = "authorizedkeys"
+
+// AuthorizedKeyDoc is the persistent representation of a single
+// authorized ssh key recorded against a User. It is a plain, facade
+// agnostic type: apiserver/keymanager.stateBacking translates between
+// this and keymanager.Key, so that package state never needs to import
+// apiserver/keymanager.
+type AuthorizedKeyDoc struct {
+	DocID       string     `bson:"_id"`
+	User        string     `bson:"user"`
+	Fingerprint string     `bson:"fingerprint"`
+	Comment     string     `bson:"comment"`
+	Algorithm   string     `bson:"algorithm"`
+	Bits        int        `bson:"bits"`
+	Source      string     `bson:"source"`
+	Created     time.Time  `bson:"created"`
+	Expires     *time.Time `bson:"expires,omitempty"`
+	Role        string     `bson:"role"`
+	Key         string     `bson:"key"`
+}
+
+func authorizedKeyDocID(user, fingerprint string) string {
+	return fmt.Sprintf("%s#%s", user, fingerprint)
+}
+
+// AuthorizedKeys returns the ssh keys currently recorded for u.
+func (u *User) AuthorizedKeys() []AuthorizedKeyDoc {
+	coll, closer := u.st.getCollection(authorizedKeysC)
+	defer closer()
+
+	var docs []AuthorizedKeyDoc
+	if err := coll.Find(bson.D{{"user", u.Name()}}).All(&docs); err != nil {
+		return nil
+	}
+	return docs
+}
+
+// SetAuthorizedKeys replaces the full set of ssh keys recorded for u with
+// keys.
+func (u *User) SetAuthorizedKeys(keys []AuthorizedKeyDoc) error {
+	coll, closer := u.st.getCollection(authorizedKeysC)
+	defer closer()
+
+	if _, err := coll.Writeable().RemoveAll(bson.D{{"user", u.Name()}}); err != nil {
+		return errors.Annotatef(err, "clearing authorized keys for %q", u.Name())
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(keys))
+	for i, key := range keys {
+		key.User = u.Name()
+		key.DocID = authorizedKeyDocID(u.Name(), key.Fingerprint)
+		docs[i] = key
+	}
+	if err := coll.Writeable().Insert(docs...); err != nil {
+		return errors.Annotatef(err, "setting authorized keys for %q", u.Name())
+	}
+	return nil
+}
+
+// AllUsers returns every user known to the environment.
+func (st *State) AllUsers() ([]*User, error) {
+	coll, closer := st.getCollection(usersC)
+	defer closer()
+
+	var docs []userDoc
+	if err := coll.Find(nil).All(&docs); err != nil && err != mgo.ErrNotFound {
+		return nil, errors.Annotate(err, "listing users")
+	}
+	users := make([]*User, len(docs))
+	for i, doc := range docs {
+		users[i] = &User{st: st, doc: doc}
+	}
+	return users, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package state
+
+import (
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sshCAC holds the single, per-environment document recording the SSH
+// CA's keypair and the certificate serials that have been revoked.
+const sshCAC = "sshca"
+
+// sshCADocID is the _id of the environment's lone sshCADoc.
+const sshCADocID = "sshca"
+
+type sshCADoc struct {
+	DocID          string   `bson:"_id"`
+	PrivateKeyPEM  []byte   `bson:"privatekey,omitempty"`
+	NextSerial     uint64   `bson:"nextserial"`
+	RevokedSerials []uint64 `bson:"revokedserials"`
+}
+
+// SSHCA is a handle onto the environment's SSH CA keypair and revocation
+// list.
+type SSHCA struct {
+	st  *State
+	doc sshCADoc
+}
+
+// SSHCA returns the environment's SSH CA, creating its (empty) document
+// the first time it is called.
+func (st *State) SSHCA() (*SSHCA, error) {
+	coll, closer := st.getCollection(sshCAC)
+	defer closer()
+
+	var doc sshCADoc
+	err := coll.FindId(sshCADocID).One(&doc)
+	if err == mgo.ErrNotFound {
+		doc = sshCADoc{DocID: sshCADocID}
+		if err := coll.Writeable().Insert(doc); err != nil && !mgo.IsDup(err) {
+			return nil, errors.Annotate(err, "initialising SSH CA document")
+		}
+	} else if err != nil {
+		return nil, errors.Annotate(err, "reading SSH CA document")
+	}
+	return &SSHCA{st: st, doc: doc}, nil
+}
+
+// PrivateKey returns the PEM encoded CA private key, or nil if the
+// environment has not yet provisioned one.
+func (ca *SSHCA) PrivateKey() []byte {
+	return ca.doc.PrivateKeyPEM
+}
+
+// SetPrivateKey persists a newly generated (or rotated) CA private key.
+func (ca *SSHCA) SetPrivateKey(pemBytes []byte) error {
+	coll, closer := ca.st.getCollection(sshCAC)
+	defer closer()
+
+	update := bson.D{{"$set", bson.D{{"privatekey", pemBytes}}}}
+	if err := coll.Writeable().UpdateId(ca.doc.DocID, update); err != nil {
+		return errors.Annotate(err, "setting SSH CA private key")
+	}
+	ca.doc.PrivateKeyPEM = pemBytes
+	return nil
+}
+
+// NextCertSerial atomically allocates the next certificate serial number.
+func (ca *SSHCA) NextCertSerial() (uint64, error) {
+	coll, closer := ca.st.getCollection(sshCAC)
+	defer closer()
+
+	change := mgo.Change{
+		Update:    bson.D{{"$inc", bson.D{{"nextserial", 1}}}},
+		ReturnNew: true,
+	}
+	var doc sshCADoc
+	if _, err := coll.Writeable().FindId(ca.doc.DocID).Apply(change, &doc); err != nil {
+		return 0, errors.Annotate(err, "allocating certificate serial")
+	}
+	ca.doc.NextSerial = doc.NextSerial
+	return doc.NextSerial, nil
+}
+
+// RevokedSerials returns every certificate serial that has been revoked.
+func (ca *SSHCA) RevokedSerials() []uint64 {
+	return ca.doc.RevokedSerials
+}
+
+// RevokeSerial marks serial as revoked.
+func (ca *SSHCA) RevokeSerial(serial uint64) error {
+	coll, closer := ca.st.getCollection(sshCAC)
+	defer closer()
+
+	update := bson.D{{"$addToSet", bson.D{{"revokedserials", serial}}}}
+	if err := coll.Writeable().UpdateId(ca.doc.DocID, update); err != nil {
+		return errors.Annotate(err, "revoking certificate serial")
+	}
+	ca.doc.RevokedSerials = append(ca.doc.RevokedSerials, serial)
+	return nil
+}
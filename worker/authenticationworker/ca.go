@@ -0,0 +1,144 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package authenticationworker
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/api/watcher"
+	"github.com/juju/juju/worker"
+)
+
+// trustedUserCAKeysFile is where machine agents publish the environment's
+// SSH CA public key for sshd to trust, as referenced by
+// caSSHDConfigDirectives. It is a var so tests can redirect it.
+var trustedUserCAKeysFile = "/etc/ssh/trusted-user-ca-keys"
+
+// revokedKeysKRLFile is where machine agents publish the environment SSH
+// CA's certificate revocation list, as referenced by
+// caSSHDConfigDirectives. It is a var so tests can redirect it.
+var revokedKeysKRLFile = "/etc/ssh/revoked-keys.krl"
+
+// sshdConfigFile is sshd's main configuration file. It is a var so tests
+// can redirect it.
+var sshdConfigFile = "/etc/ssh/sshd_config"
+
+// caSSHDConfigDirectives returns the sshd_config lines that must be
+// present for sshd to honour certificates signed by the key in
+// trustedUserCAKeysFile, and to reject the ones revoked in
+// revokedKeysKRLFile.
+func caSSHDConfigDirectives() []string {
+	return []string{
+		"TrustedUserCAKeys " + trustedUserCAKeysFile,
+		"RevokedKeys " + revokedKeysKRLFile,
+	}
+}
+
+// caFacade is the subset of api/keymanager.Client the CA worker needs, so
+// tests can supply a fake.
+type caFacade interface {
+	CAPublicKey() (string, error)
+	RevokedKRL() ([]byte, error)
+	WatchCAPublicKey() (watcher.NotifyWatcher, error)
+}
+
+// NewCAWorker returns a worker that keeps trustedUserCAKeysFile and
+// revokedKeysKRLFile in sync with the environment's SSH CA, and ensures
+// sshd is configured to honour them. It is a no-op, once set up, on
+// environments that are not running in SSH CA mode (CAPublicKey returns
+// "").
+func NewCAWorker(facade caFacade) worker.Worker {
+	return worker.NewNotifyWorker(&caWorker{facade: facade})
+}
+
+type caWorker struct {
+	facade caFacade
+}
+
+// SetUp is part of worker.NotifyWatchHandler.
+func (w *caWorker) SetUp() (watcher.NotifyWatcher, error) {
+	return w.facade.WatchCAPublicKey()
+}
+
+// Handle is part of worker.NotifyWatchHandler. The CA's public key and
+// its certificate revocation list live on the same environment-wide
+// document, so a single watcher firing on either a rotation or a
+// revocation is enough to reconcile both files here.
+func (w *caWorker) Handle() error {
+	pubKey, err := w.facade.CAPublicKey()
+	if err != nil {
+		return errors.Annotate(err, "fetching CA public key")
+	}
+	if pubKey == "" {
+		// The environment isn't running in SSH CA mode.
+		return nil
+	}
+	if err := ioutil.WriteFile(trustedUserCAKeysFile, []byte(pubKey), 0644); err != nil {
+		return errors.Annotatef(err, "writing %s", trustedUserCAKeysFile)
+	}
+	krl, err := w.facade.RevokedKRL()
+	if err != nil {
+		return errors.Annotate(err, "fetching CA certificate revocation list")
+	}
+	if err := ioutil.WriteFile(revokedKeysKRLFile, krl, 0644); err != nil {
+		return errors.Annotatef(err, "writing %s", revokedKeysKRLFile)
+	}
+	if err := ensureSSHDConfig(); err != nil {
+		return errors.Trace(err)
+	}
+	return reloadSSHD()
+}
+
+// TearDown is part of worker.NotifyWatchHandler.
+func (w *caWorker) TearDown() error {
+	return nil
+}
+
+// ensureSSHDConfig appends any of caSSHDConfigDirectives missing from
+// sshdConfigFile, so sshd trusts trustedUserCAKeysFile and honours
+// revokedKeysKRLFile without an operator having to template them in by
+// hand.
+func ensureSSHDConfig() error {
+	existing, err := ioutil.ReadFile(sshdConfigFile)
+	if err != nil {
+		return errors.Annotatef(err, "reading %s", sshdConfigFile)
+	}
+	lines := strings.Split(string(existing), "\n")
+	present := make(map[string]bool)
+	for _, line := range lines {
+		present[strings.TrimSpace(line)] = true
+	}
+	content := string(existing)
+	for _, directive := range caSSHDConfigDirectives() {
+		if present[directive] {
+			continue
+		}
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += directive + "\n"
+	}
+	if content == string(existing) {
+		return nil
+	}
+	if err := ioutil.WriteFile(sshdConfigFile, []byte(content), 0644); err != nil {
+		return errors.Annotatef(err, "writing %s", sshdConfigFile)
+	}
+	return nil
+}
+
+// reloadSSHD asks sshd to reload its configuration, so the files and
+// directives ensureSSHDConfig and Handle just wrote take effect without a
+// full restart. It is a var so tests can replace it.
+var reloadSSHD = func() error {
+	out, err := exec.Command("service", "ssh", "reload").CombinedOutput()
+	if err != nil {
+		return errors.Annotatef(err, "reloading sshd: %s", out)
+	}
+	return nil
+}
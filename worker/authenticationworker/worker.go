@@ -0,0 +1,79 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package authenticationworker runs on every machine agent, keeping the
+// ssh access it grants in sync with the model: it writes the merged,
+// role-annotated authorized_keys file for every Juju user with access
+// whenever the KeyManager facade reports a change, and (when the
+// environment is in SSH CA mode) keeps /etc/ssh/trusted-user-ca-keys and
+// sshd_config's TrustedUserCAKeys option pointed at the environment's
+// current CA.
+package authenticationworker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/api/watcher"
+	"github.com/juju/juju/worker"
+)
+
+// sshDir is the directory containing the local user's authorized_keys
+// file; it is a var so tests can redirect it.
+var sshDir = "/home/ubuntu/.ssh"
+
+const authorizedKeysFile = "authorized_keys"
+
+// keyManagerFacade is the subset of api/keymanager.Client the worker
+// needs, so tests can supply a fake.
+type keyManagerFacade interface {
+	AuthorizedKeysFile() (string, error)
+	WatchAuthorizedKeys() (watcher.NotifyWatcher, error)
+}
+
+// NewWorker returns a worker that reconciles the unit's authorized_keys
+// file against every Juju user's keys, every time the KeyManager facade
+// reports that any of them have changed. Any Juju user may have been
+// granted access to any unit, so there is no single "owning" username to
+// scope the request to - unlike, eg, the machine or unit tag the worker
+// runs under.
+func NewWorker(facade keyManagerFacade) worker.Worker {
+	return worker.NewNotifyWorker(newKeysWorker(facade))
+}
+
+func newKeysWorker(facade keyManagerFacade) *keysWorker {
+	return &keysWorker{facade: facade}
+}
+
+type keysWorker struct {
+	facade keyManagerFacade
+}
+
+// SetUp is part of worker.NotifyWatchHandler.
+func (u *keysWorker) SetUp() (watcher.NotifyWatcher, error) {
+	return u.facade.WatchAuthorizedKeys()
+}
+
+// Handle is part of worker.NotifyWatchHandler.
+func (u *keysWorker) Handle() error {
+	content, err := u.facade.AuthorizedKeysFile()
+	if err != nil {
+		return errors.Annotate(err, "fetching authorized keys")
+	}
+	if err := os.MkdirAll(sshDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	path := filepath.Join(sshDir, authorizedKeysFile)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return errors.Annotatef(err, "writing %s", path)
+	}
+	return nil
+}
+
+// TearDown is part of worker.NotifyWatchHandler.
+func (u *keysWorker) TearDown() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package authenticationworker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju/api/watcher"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type WorkerSuite struct{}
+
+var _ = gc.Suite(&WorkerSuite{})
+
+type fakeKeyManagerFacade struct {
+	content string
+	err     error
+}
+
+func (f fakeKeyManagerFacade) AuthorizedKeysFile() (string, error) {
+	return f.content, f.err
+}
+
+func (f fakeKeyManagerFacade) WatchAuthorizedKeys() (watcher.NotifyWatcher, error) {
+	return nil, nil
+}
+
+func (s *WorkerSuite) TestHandleWritesAuthorizedKeysFile(c *gc.C) {
+	dir := c.MkDir()
+	original := sshDir
+	sshDir = dir
+	defer func() { sshDir = original }()
+
+	u := newKeysWorker(fakeKeyManagerFacade{content: "ssh-rsa AAAA user@host\n"})
+	c.Assert(u.Handle(), jc.ErrorIsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, authorizedKeysFile))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "ssh-rsa AAAA user@host\n")
+}
+
+type fakeCAFacade struct {
+	pubKey string
+	krl    []byte
+	err    error
+}
+
+func (f fakeCAFacade) CAPublicKey() (string, error) {
+	return f.pubKey, f.err
+}
+
+func (f fakeCAFacade) RevokedKRL() ([]byte, error) {
+	return f.krl, nil
+}
+
+func (f fakeCAFacade) WatchCAPublicKey() (watcher.NotifyWatcher, error) {
+	return nil, nil
+}
+
+func (s *WorkerSuite) TestCAHandleSkipsWhenNotInCAMode(c *gc.C) {
+	w := &caWorker{facade: fakeCAFacade{pubKey: ""}}
+	c.Assert(w.Handle(), jc.ErrorIsNil)
+}
+
+func (s *WorkerSuite) TestCAHandleWritesKeysAndReloadsSSHD(c *gc.C) {
+	dir := c.MkDir()
+	for _, f := range []*string{&trustedUserCAKeysFile, &revokedKeysKRLFile, &sshdConfigFile} {
+		original := *f
+		*f = filepath.Join(dir, filepath.Base(*f))
+		defer func(f *string, original string) { *f = original }(f, original)
+	}
+	c.Assert(ioutil.WriteFile(sshdConfigFile, []byte("Port 22\n"), 0644), jc.ErrorIsNil)
+
+	reloaded := false
+	originalReload := reloadSSHD
+	reloadSSHD = func() error {
+		reloaded = true
+		return nil
+	}
+	defer func() { reloadSSHD = originalReload }()
+
+	w := &caWorker{facade: fakeCAFacade{pubKey: "ssh-rsa AAAA ca\n", krl: []byte("krl-bytes")}}
+	c.Assert(w.Handle(), jc.ErrorIsNil)
+
+	pubKey, err := ioutil.ReadFile(trustedUserCAKeysFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(pubKey), gc.Equals, "ssh-rsa AAAA ca\n")
+
+	krl, err := ioutil.ReadFile(revokedKeysKRLFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(krl), gc.Equals, "krl-bytes")
+
+	config, err := ioutil.ReadFile(sshdConfigFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(config), jc.Contains, "TrustedUserCAKeys "+trustedUserCAKeysFile)
+	c.Assert(string(config), jc.Contains, "RevokedKeys "+revokedKeysKRLFile)
+
+	c.Assert(reloaded, jc.IsTrue)
+}